@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// casSubdir is where verified artifacts are stored, addressed by the
+// SHA-256 digest of their contents, e.g. <data>/.cache/sha256/ab/ab34...
+const casSubdir = ".cache/sha256"
+
+// digestIndexSubdir records the last known digest for each logical
+// filename, so that a file removed from the data directory can be restored
+// from the CAS without a network round-trip.
+const digestIndexSubdir = ".cache/index"
+
+// sha256File hashes the contents of path and returns its hex-encoded digest.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return "", errwrap.Wrapf("Unable to open file for hashing. {{err}}", err)
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errwrap.Wrapf("Unable to hash file. {{err}}", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// casPath returns the content-addressed path for a given digest within
+// dataFilePath's cache.
+func casPath(dataFilePath string, digest string) string {
+	return filepath.Join(dataFilePath, casSubdir, digest[:2], digest)
+}
+
+// digestIndexPath returns where the last-known digest for a logical
+// filename is recorded.
+func digestIndexPath(dataFilePath string, filename string) string {
+	return filepath.Join(dataFilePath, digestIndexSubdir, filename+".sha256")
+}
+
+// storeInCAS records tempFilePath's contents under dataFilePath's
+// content-addressed cache, keyed by digest - the SHA-256 digest the caller
+// already computed while streaming the download to tempFilePath, so this
+// doesn't have to re-read the file to hash it again. It is safe to call when
+// the blob is already present in the cache.
+func storeInCAS(dataFilePath string, tempFilePath string, digest string) error {
+	dest := casPath(dataFilePath, digest)
+
+	if exists(dest) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return errwrap.Wrapf("Unable to create CAS directory. {{err}}", err)
+	}
+
+	if err := os.Link(tempFilePath, dest); err != nil {
+		// Hard linking fails across filesystem boundaries - e.g. when the
+		// temp directory and the data directory's cache aren't on the same
+		// device - so fall back to a copy.
+		if copyErr := copyFile(tempFilePath, dest); copyErr != nil {
+			return errwrap.Wrapf("Unable to store artifact in CAS. {{err}}", copyErr)
+		}
+	}
+
+	return nil
+}
+
+// recordDigest remembers that filename's current contents have the given
+// digest.
+func recordDigest(dataFilePath string, filename string, digest string) error {
+	indexPath := digestIndexPath(dataFilePath, filename)
+
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0755); err != nil {
+		return errwrap.Wrapf("Unable to create CAS index directory. {{err}}", err)
+	}
+
+	return ioutil.WriteFile(indexPath, []byte(digest), 0644)
+}
+
+// lookupRecordedDigest returns the digest previously recorded for filename,
+// if any.
+func lookupRecordedDigest(dataFilePath string, filename string) (string, bool) {
+	contents, err := ioutil.ReadFile(digestIndexPath(dataFilePath, filename))
+
+	if err != nil {
+		return "", false
+	}
+
+	return string(contents), true
+}
+
+// restoreFromCAS hard-links (or copies) the cached blob for digest directly
+// into localFilePath, letting a run skip the network entirely when the
+// artifact is already known. It reports false, rather than an error, when
+// the digest simply isn't in the cache.
+func restoreFromCAS(dataFilePath string, digest string, localFilePath string) (bool, error) {
+	src := casPath(dataFilePath, digest)
+
+	if !exists(src) {
+		return false, nil
+	}
+
+	if err := os.Link(src, localFilePath); err != nil {
+		if copyErr := copyFile(src, localFilePath); copyErr != nil {
+			return false, errwrap.Wrapf("Unable to restore artifact from CAS. {{err}}", copyErr)
+		}
+	}
+
+	return true, nil
+}
+
+// copyFile copies src to dest, used as a fallback wherever a hard link
+// isn't possible.
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dest)
+
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+
+	return err
+}
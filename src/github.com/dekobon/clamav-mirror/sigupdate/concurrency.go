@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Progress describes the state of an in-flight signature update. It is
+// handed to a ProgressFunc as each downloaded CDIFF is committed so that the
+// library form of runSignatureUpdate can be wrapped by a TUI or logged as
+// structured events.
+type Progress struct {
+	Signature       string
+	BytesDownloaded int64
+	FilesCompleted  int
+	TotalFiles      int
+	Started         time.Time
+}
+
+// ETA estimates the time remaining to complete the current signature's
+// downloads based on the average time taken per file so far.
+func (p Progress) ETA() time.Duration {
+	if p.FilesCompleted < 1 || p.FilesCompleted >= p.TotalFiles {
+		return 0
+	}
+
+	elapsed := time.Since(p.Started)
+	perFile := elapsed / time.Duration(p.FilesCompleted)
+	remaining := p.TotalFiles - p.FilesCompleted
+
+	return perFile * time.Duration(remaining)
+}
+
+// ProgressFunc is invoked each time a CDIFF from the worker pool is committed
+// into the data directory. Commits begin only once every download in the
+// batch has finished, so no call is made while downloads are still running,
+// and full CVD downloads are not reported. It may be nil, in which case
+// progress reporting is skipped.
+type ProgressFunc func(Progress)
+
+// diffDownloadResult carries the outcome of downloading a single CDIFF back
+// from a worker to the coordinator so that renames can be committed in
+// ascending version order.
+type diffDownloadResult struct {
+	version      int64
+	tempFilePath string
+	lastModified time.Time
+	bytes        int64
+	digest       string
+	err          error
+}
+
+// downloadDiffsWithWorkerPool fetches each of the requested CDIFF versions
+// for filePrefix using a bounded pool of workers, then commits the
+// downloaded temp files into the data directory in ascending version order.
+// Commits stop at the first version that failed to download so that the
+// diff chain on disk never has a gap; the caller is expected to fall back to
+// redownloading the full signature file when that happens.
+func downloadDiffsWithWorkerPool(logger *slog.Logger, dataFilePath string,
+	downloadMirrorURL string, verifier Verifier, parallelDownloads uint16, progressFn ProgressFunc,
+	filePrefix string, versions []int64) error {
+	separator := string(filepath.Separator)
+	started := time.Now()
+
+	workers := int(parallelDownloads)
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int64, len(versions))
+	results := make(chan diffDownloadResult, len(versions))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for version := range jobs {
+				diffFilename := filePrefix + "-" + strconv.FormatInt(version, 10) + ".cdiff"
+				statusCode, tempFilePath, lastModified, n, digest, err := fetchToTempFile(logger,
+					diffFilename, downloadMirrorURL, verifier)
+
+				if err != nil {
+					msg := fmt.Sprintf("Error downloading diff [%v] (status %v). {{err}}",
+						diffFilename, statusCode)
+					err = errwrap.Wrapf(msg, err)
+				}
+
+				results <- diffDownloadResult{
+					version:      version,
+					tempFilePath: tempFilePath,
+					lastModified: lastModified,
+					bytes:        n,
+					digest:       digest,
+					err:          err,
+				}
+			}
+		}()
+	}
+
+	for _, version := range versions {
+		jobs <- version
+	}
+
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	resultsByVersion := make(map[int64]diffDownloadResult, len(versions))
+
+	for result := range results {
+		resultsByVersion[result.version] = result
+	}
+
+	var filesCompleted int
+	var bytesDownloaded int64
+
+	for _, version := range versions {
+		result := resultsByVersion[version]
+
+		if result.err != nil {
+			removeLeftoverTempFiles(logger, resultsByVersion)
+			return result.err
+		}
+
+		diffFilename := filePrefix + "-" + strconv.FormatInt(version, 10) + ".cdiff"
+		localDiffFilePath := dataFilePath + separator + diffFilename
+
+		err := commitDownload(result.tempFilePath, localDiffFilePath, result.lastModified, result.digest)
+
+		if err != nil {
+			return err
+		}
+
+		filesCompleted++
+		bytesDownloaded += result.bytes
+
+		logger.Info("sig.diff.downloaded", "signature", filePrefix, "version", version,
+			"bytes", result.bytes, "duration_ms", time.Since(started).Milliseconds(),
+			"files_completed", filesCompleted, "total_files", len(versions))
+
+		if progressFn != nil {
+			progressFn(Progress{
+				Signature:       filePrefix,
+				BytesDownloaded: bytesDownloaded,
+				FilesCompleted:  filesCompleted,
+				TotalFiles:      len(versions),
+				Started:         started,
+			})
+		}
+	}
+
+	return nil
+}
+
+// removeLeftoverTempFiles cleans up the temp files produced by workers whose
+// downloads finished successfully but were never committed because an
+// earlier version in the batch failed first. Without this, every diff
+// download that errors out leaks its siblings' completed-but-uncommitted
+// files in os.TempDir() for good.
+func removeLeftoverTempFiles(logger *slog.Logger, resultsByVersion map[int64]diffDownloadResult) {
+	for _, result := range resultsByVersion {
+		if result.tempFilePath == "" {
+			continue
+		}
+
+		if err := os.Remove(result.tempFilePath); err != nil && !os.IsNotExist(err) {
+			logger.Warn("sig.diff.cleanup_failed", "path", result.tempFilePath, "error", err)
+		}
+	}
+}
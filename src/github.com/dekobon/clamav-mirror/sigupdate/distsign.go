@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Verifier validates the authenticity of a downloaded signature artifact
+// before it is allowed to be promoted from its temporary file into the data
+// directory.
+type Verifier interface {
+	// Verify checks the contents at tempFilePath against the detached
+	// signature published alongside filename on the mirror. A non-nil
+	// error means the artifact must be discarded.
+	Verify(downloadMirrorURL string, filename string, tempFilePath string) error
+}
+
+// noopVerifier is used when signature verification has not been enabled by
+// the operator. It accepts every artifact unconditionally.
+type noopVerifier struct{}
+
+func (noopVerifier) Verify(downloadMirrorURL string, filename string, tempFilePath string) error {
+	return nil
+}
+
+// signingKeyBundle is the JSON document published at --signing-keys-url. It
+// contains one or more Ed25519 signing keys along with a signature over the
+// bundle made by the pinned root key, mirroring the root key -> signing key
+// -> per-artifact signature chain used by ClamAV's distsign tooling.
+type signingKeyBundle struct {
+	Keys      []string `json:"keys"`
+	Signature string   `json:"signature"`
+}
+
+// distsignVerifier implements Verifier using a root public key loaded from
+// the --root-key file at startup, a remote bundle of signing keys countersigned by
+// that root key, and per-artifact ".sig" files published next to each CVD
+// and CDIFF on the mirror. When requireSignatures is false, a failed check
+// is logged as a warning rather than rejecting the artifact - this is the
+// "verify and warn" mode implied by --root-key on its own.
+type distsignVerifier struct {
+	rootKey           ed25519.PublicKey
+	signingKeysURL    string
+	requireSignatures bool
+	logger            *slog.Logger
+	client            *http.Client
+
+	signingKeysOnce sync.Once
+	signingKeysErr  error
+	signingKeys     []ed25519.PublicKey
+}
+
+// newDistsignVerifier loads the root public key from rootKeyPath and returns
+// a Verifier that will lazily fetch and validate the signing key bundle from
+// signingKeysURL on first use. requireSignatures controls whether a failed
+// verification rejects the artifact (true) or is merely logged (false).
+func newDistsignVerifier(logger *slog.Logger, rootKeyPath string, signingKeysURL string,
+	requireSignatures bool) (Verifier, error) {
+	rootKey, err := loadPublicKey(rootKeyPath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to load root key from [%v]. {{err}}", rootKeyPath)
+		return nil, errwrap.Wrapf(msg, err)
+	}
+
+	return &distsignVerifier{
+		rootKey:           rootKey,
+		signingKeysURL:    signingKeysURL,
+		requireSignatures: requireSignatures,
+		logger:            logger,
+		client:            &http.Client{},
+	}, nil
+}
+
+// handleVerificationFailure applies requireSignatures' enforcement policy to
+// a verification error: reject the artifact when signatures are required,
+// otherwise log a warning and let the download through.
+func (v *distsignVerifier) handleVerificationFailure(filename string, err error) error {
+	if v.requireSignatures {
+		return err
+	}
+
+	v.logger.Warn("sig.verify.failed", "file", filename, "error", err)
+
+	return nil
+}
+
+// loadPublicKey reads a hex-encoded Ed25519 public key from path.
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to read key file. {{err}}", err)
+	}
+
+	keyBytes, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to parse key file as hex. {{err}}", err)
+	}
+
+	if len(keyBytes) != ed25519.PublicKeySize {
+		msg := fmt.Sprintf("Key file [%v] does not contain a valid Ed25519 public key", path)
+		return nil, errors.New(msg)
+	}
+
+	return ed25519.PublicKey(keyBytes), nil
+}
+
+// ensureSigningKeys fetches and validates the signing key bundle the first
+// time it is needed, caching the result for subsequent calls. It is called
+// concurrently - once per verified artifact, from every worker across every
+// signature database being updated - so the fetch itself only ever runs once, guarded by a
+// sync.Once, with every caller observing the same cached result or error.
+func (v *distsignVerifier) ensureSigningKeys() error {
+	v.signingKeysOnce.Do(func() {
+		v.signingKeysErr = v.fetchSigningKeys()
+	})
+
+	return v.signingKeysErr
+}
+
+// fetchSigningKeys performs the actual network fetch and validation behind
+// ensureSigningKeys' sync.Once.
+func (v *distsignVerifier) fetchSigningKeys() error {
+	response, err := v.client.Get(v.signingKeysURL)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to retrieve signing keys from: [%v]. {{err}}", v.signingKeysURL)
+		return errwrap.Wrapf(msg, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("Unable to download signing keys: [%v]", response.Status)
+		return errors.New(msg)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return errwrap.Wrapf("Unable to read signing keys response body. {{err}}", err)
+	}
+
+	var bundle signingKeyBundle
+
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		return errwrap.Wrapf("Unable to parse signing keys bundle JSON. {{err}}", err)
+	}
+
+	bundleSig, err := hex.DecodeString(bundle.Signature)
+
+	if err != nil {
+		return errwrap.Wrapf("Unable to parse signing keys bundle signature as hex. {{err}}", err)
+	}
+
+	keysJoined := strings.Join(bundle.Keys, "\n")
+
+	if !ed25519.Verify(v.rootKey, []byte(keysJoined), bundleSig) {
+		return errors.New("Signing keys bundle failed validation against the pinned root key")
+	}
+
+	signingKeys := make([]ed25519.PublicKey, 0, len(bundle.Keys))
+
+	for _, k := range bundle.Keys {
+		keyBytes, err := hex.DecodeString(k)
+
+		if err != nil {
+			return errwrap.Wrapf("Unable to parse signing key as hex. {{err}}", err)
+		}
+
+		if len(keyBytes) != ed25519.PublicKeySize {
+			return errors.New("Signing keys bundle contains an invalid Ed25519 public key")
+		}
+
+		signingKeys = append(signingKeys, ed25519.PublicKey(keyBytes))
+	}
+
+	if len(signingKeys) < 1 {
+		return errors.New("Signing keys bundle did not contain any keys")
+	}
+
+	v.signingKeys = signingKeys
+
+	return nil
+}
+
+// Verify implements Verifier by downloading the detached ".sig" file
+// published next to filename and checking it against the validated signing
+// keys.
+func (v *distsignVerifier) Verify(downloadMirrorURL string, filename string, tempFilePath string) error {
+	if err := v.ensureSigningKeys(); err != nil {
+		return v.handleVerificationFailure(filename, err)
+	}
+
+	sigURL := downloadMirrorURL + "/" + filename + ".sig"
+
+	response, err := v.client.Get(sigURL)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to retrieve signature from: [%v]. {{err}}", sigURL)
+		return v.handleVerificationFailure(filename, errwrap.Wrapf(msg, err))
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("Unable to download signature: [%v]", response.Status)
+		return v.handleVerificationFailure(filename, errors.New(msg))
+	}
+
+	sigHex, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return v.handleVerificationFailure(filename,
+			errwrap.Wrapf("Unable to read signature response body. {{err}}", err))
+	}
+
+	sig, err := hex.DecodeString(strings.TrimSpace(string(sigHex)))
+
+	if err != nil {
+		return v.handleVerificationFailure(filename,
+			errwrap.Wrapf("Unable to parse signature as hex. {{err}}", err))
+	}
+
+	artifact, err := ioutil.ReadFile(tempFilePath)
+
+	if err != nil {
+		return v.handleVerificationFailure(filename,
+			errwrap.Wrapf("Unable to read downloaded artifact for verification. {{err}}", err))
+	}
+
+	for _, signingKey := range v.signingKeys {
+		if ed25519.Verify(signingKey, artifact, sig) {
+			return nil
+		}
+	}
+
+	msg := fmt.Sprintf("Signature verification failed for [%v] - no signing key validates its signature", filename)
+	return v.handleVerificationFailure(filename, errors.New(msg))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/pborman/getopt"
+)
+
+// serveOptions bundles the flags accepted by the "sigupdate serve"
+// subcommand.
+type serveOptions struct {
+	dataFilePath       string
+	downloadMirrorURL  string
+	diffCountThreshold uint16
+	verifier           Verifier
+	parallelDownloads  uint16
+	listenAddress      string
+	refreshInterval    time.Duration
+	logger             *slog.Logger
+}
+
+// parseServeCliFlags parses the CLI options for the "sigupdate serve"
+// subcommand.
+func parseServeCliFlags() serveOptions {
+	verbosePart := getopt.BoolLong("verbose", 'v',
+		"Shorthand for --log-level=debug when --log-level is info (the default)")
+	dataFilePart := getopt.StringLong("data-file-path", 'd',
+		"/var/clamav/data", "Path to ClamAV data files")
+	diffThresholdPart := getopt.Uint16Long("diff-count-threshold", 't',
+		100, "Number of diffs to download until we redownload the signature files")
+	downloadMirrorPart := getopt.StringLong("download-mirror-url", 'm',
+		"http://database.clamav.net", "URL to download signature updates from")
+	rootKeyPart := getopt.StringLong("root-key", 0,
+		"", "Path to the pinned Ed25519 root public key used to validate the signing-key bundle")
+	signingKeysURLPart := getopt.StringLong("signing-keys-url", 0,
+		"http://database.clamav.net/signing-keys.json", "URL to download the signing-key bundle from")
+	requireSignaturesPart := getopt.BoolLong("require-signatures", 0,
+		"Reject any downloaded CVD or CDIFF that doesn't have a valid signature")
+	parallelDownloadsPart := getopt.Uint16Long("parallel-downloads", 0,
+		4, "Number of CDIFFs to download concurrently per signature database")
+	listenAddressPart := getopt.StringLong("listen-address", 'l',
+		":8080", "Address to listen for HTTP requests on")
+	refreshIntervalPart := getopt.StringLong("refresh-interval", 0,
+		"1h", "How often to refresh signatures from the upstream mirror")
+	logFormatPart, logLevelPart := addLogFlags()
+
+	getopt.Parse()
+
+	logger := newLogger(*logFormatPart, resolveLogLevel(*verbosePart, *logLevelPart))
+	dataFileAbsPath := resolveDataFilePath(logger, *dataFilePart)
+	verifier := buildVerifier(logger, *rootKeyPart, *signingKeysURLPart, *requireSignaturesPart)
+
+	refreshInterval, err := time.ParseDuration(*refreshIntervalPart)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to parse refresh interval [%v]. {{err}}", *refreshIntervalPart)
+		fatal(logger, "invalid --refresh-interval", "error", errwrap.Wrapf(msg, err))
+	}
+
+	if refreshInterval <= 0 {
+		fatal(logger, "invalid --refresh-interval", "refresh_interval", refreshInterval,
+			"reason", "must be a positive duration")
+	}
+
+	return serveOptions{
+		dataFilePath:       dataFileAbsPath,
+		downloadMirrorURL:  *downloadMirrorPart,
+		diffCountThreshold: *diffThresholdPart,
+		verifier:           verifier,
+		parallelDownloads:  *parallelDownloadsPart,
+		listenAddress:      *listenAddressPart,
+		refreshInterval:    refreshInterval,
+		logger:             logger,
+	}
+}
+
+// mirrorVersions is served as a JSON document at /versions.json, giving
+// clients a machine-readable equivalent of the DNS TXT record this mirror
+// itself consumes from upstream.
+type mirrorVersions struct {
+	Main     int64 `json:"main"`
+	Daily    int64 `json:"daily"`
+	Bytecode int64 `json:"bytecode"`
+}
+
+// cdiffPattern matches the CDIFF filenames this server is willing to serve.
+var cdiffPattern = regexp.MustCompile(`^(main|daily|bytecode)-[0-9]+\.cdiff$`)
+
+// runServe turns the data directory sigupdate maintains into an HTTP
+// mirror, refreshing its contents from upstream on an interval so that the
+// same binary can consume from one mirror and serve to another tier of
+// clients.
+func runServe(opts serveOptions) error {
+	sigtoolPath, err := findSigtoolPath()
+
+	if err != nil {
+		return err
+	}
+
+	var mu sync.RWMutex
+	var versions mirrorVersions
+
+	refresh := func() {
+		err := runSignatureUpdate(opts.logger, opts.dataFilePath, opts.downloadMirrorURL,
+			opts.diffCountThreshold, opts.verifier, opts.parallelDownloads, nil)
+
+		if err != nil {
+			opts.logger.Error("sig.refresh.failed", "error", err)
+			return
+		}
+
+		mainVersion, mErr := findLocalVersion(filepath.Join(opts.dataFilePath, "main.cvd"), sigtoolPath)
+		dailyVersion, dErr := findLocalVersion(filepath.Join(opts.dataFilePath, "daily.cvd"), sigtoolPath)
+		bytecodeVersion, bErr := findLocalVersion(filepath.Join(opts.dataFilePath, "bytecode.cvd"), sigtoolPath)
+
+		if mErr != nil || dErr != nil || bErr != nil {
+			opts.logger.Error("sig.refresh.version_read_failed", "main_error", mErr, "daily_error", dErr,
+				"bytecode_error", bErr)
+			return
+		}
+
+		/* Readers always observe either the previous complete set of
+		 * versions or the new one, never a partially updated mix. */
+		mu.Lock()
+		versions = mirrorVersions{Main: mainVersion, Daily: dailyVersion, Bytecode: bytecodeVersion}
+		mu.Unlock()
+
+		opts.logger.Info("sig.refresh.complete", "main", mainVersion, "daily", dailyVersion,
+			"bytecode", bytecodeVersion)
+	}
+
+	refresh()
+
+	go func() {
+		ticker := time.NewTicker(opts.refreshInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			refresh()
+		}
+	}()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/versions.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		v := versions
+		mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+
+	fileHandler := serveSignatureFile(opts.dataFilePath)
+
+	mux.HandleFunc("/main.cvd", fileHandler)
+	mux.HandleFunc("/daily.cvd", fileHandler)
+	mux.HandleFunc("/bytecode.cvd", fileHandler)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		filename := strings.TrimPrefix(r.URL.Path, "/")
+
+		if !cdiffPattern.MatchString(filename) {
+			http.NotFound(w, r)
+			return
+		}
+
+		fileHandler(w, r)
+	})
+
+	opts.logger.Info("sig.serve.start", "data_file_path", opts.dataFilePath, "listen_address", opts.listenAddress)
+
+	return http.ListenAndServe(opts.listenAddress, mux)
+}
+
+// serveSignatureFile returns a handler that serves the requested artifact
+// out of dataFilePath using http.ServeContent, which honors
+// If-Modified-Since and If-None-Match against the Last-Modified and ETag it
+// is given. The ETag is the artifact's recorded SHA-256 digest when the
+// content-addressed cache has one, falling back to a weak tag derived from
+// size and modification time otherwise.
+func serveSignatureFile(dataFilePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filename := strings.TrimPrefix(r.URL.Path, "/")
+		localFilePath := filepath.Join(dataFilePath, filename)
+
+		info, err := os.Stat(localFilePath)
+
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if digest, ok := lookupRecordedDigest(dataFilePath, filename); ok {
+			w.Header().Set("ETag", "\""+digest+"\"")
+		} else {
+			w.Header().Set("ETag", fmt.Sprintf("W/\"%x-%x\"", info.ModTime().Unix(), info.Size()))
+		}
+
+		f, err := os.Open(localFilePath)
+
+		if err != nil {
+			http.Error(w, "Unable to open file", http.StatusInternalServerError)
+			return
+		}
+
+		defer f.Close()
+
+		http.ServeContent(w, r, filename, info.ModTime(), f)
+	}
+}
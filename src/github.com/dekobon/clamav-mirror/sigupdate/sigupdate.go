@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math"
 	"net"
 	"net/http"
@@ -15,6 +17,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,33 +29,52 @@ import (
 var githash = "unknown"
 var buildstamp = "unknown"
 
-var logger *log.Logger
-var logFatal *log.Logger
-
-func init() {
-	logger = log.New(os.Stdout, "", log.LstdFlags)
-	logFatal = log.New(os.Stderr, "", log.LstdFlags|log.Lshortfile)
-}
-
 // Main entry point to the downloader application. This will allow you to run
 // the downloader as a stand-alone binary.
 func main() {
-	err := runSignatureUpdate(parseCliFlags())
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		// Drop the subcommand before handing the remaining arguments to
+		// getopt, which otherwise expects only flags.
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+
+		opts := parseVerifyCliFlags()
+
+		if err := runVerify(opts); err != nil {
+			fatal(opts.logger, err.Error())
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+
+		opts := parseServeCliFlags()
+
+		if err := runServe(opts); err != nil {
+			fatal(opts.logger, err.Error())
+		}
+
+		return
+	}
+
+	opts := parseCliFlags()
+	err := runSignatureUpdate(opts.logger, opts.dataFilePath, opts.downloadMirrorURL,
+		opts.diffCountThreshold, opts.verifier, opts.parallelDownloads, nil)
 
 	if err != nil {
-		logFatal.Fatal(err)
+		fatal(opts.logger, err.Error())
 	}
 }
 
 // Functional entry point to the application. Use this method to invoke the
-// downloader from external code.
-func runSignatureUpdate(verboseMode bool, dataFilePath string, downloadMirrorURL string,
-	diffCountThreshold uint16) error {
-	logger.Println("Updating ClamAV signatures")
-
-	if verboseMode {
-		logger.Printf("Data file directory: %v", dataFilePath)
-	}
+// downloader from external code. progressFn may be nil; when supplied, it is
+// invoked as each downloaded CDIFF is committed so that a caller can render
+// progress or emit structured events.
+func runSignatureUpdate(logger *slog.Logger, dataFilePath string, downloadMirrorURL string,
+	diffCountThreshold uint16, verifier Verifier, parallelDownloads uint16,
+	progressFn ProgressFunc) error {
+	logger.Info("sig.update.start", "data_file_path", dataFilePath, "download_mirror_url", downloadMirrorURL)
 
 	sigtoolPath, err := findSigtoolPath()
 
@@ -60,9 +82,7 @@ func runSignatureUpdate(verboseMode bool, dataFilePath string, downloadMirrorURL
 		return err
 	}
 
-	if verboseMode {
-		logger.Printf("ClamAV executable sigtool found at path: %v", sigtoolPath)
-	}
+	logger.Debug("ClamAV executable sigtool found", "path", sigtoolPath)
 
 	mirrorDomain := "current.cvd.clamav.net"
 	mirrorTxtRecord, err := pullTxtRecord(mirrorDomain)
@@ -71,9 +91,7 @@ func runSignatureUpdate(verboseMode bool, dataFilePath string, downloadMirrorURL
 		return err
 	}
 
-	if verboseMode {
-		logger.Printf("TXT record for [%v]: %v", mirrorDomain, mirrorTxtRecord)
-	}
+	logger.Debug("resolved mirror TXT record", "domain", mirrorDomain, "record", mirrorTxtRecord)
 
 	versions, err := parseTxtRecord(mirrorTxtRecord)
 
@@ -81,9 +99,7 @@ func runSignatureUpdate(verboseMode bool, dataFilePath string, downloadMirrorURL
 		return err
 	}
 
-	if verboseMode {
-		logger.Printf("TXT record values parsed: %v", versions)
-	}
+	logger.Debug("parsed TXT record", "versions", versions)
 
 	var signaturesToUpdate = [3]Signature{
 		{Name: "main", Version: versions.MainVersion},
@@ -91,10 +107,27 @@ func runSignatureUpdate(verboseMode bool, dataFilePath string, downloadMirrorURL
 		{Name: "bytecode", Version: versions.ByteCodeVersion},
 	}
 
+	/* The three signature databases are independent of one another, so we
+	 * update them concurrently rather than paying their HTTP round-trip
+	 * latency serially. */
+	errs := make(chan error, len(signaturesToUpdate))
+	var wg sync.WaitGroup
+
 	for _, signature := range signaturesToUpdate {
-		err = updateFile(verboseMode, dataFilePath, sigtoolPath, signature,
-			downloadMirrorURL, diffCountThreshold)
+		wg.Add(1)
+
+		go func(signature Signature) {
+			defer wg.Done()
+
+			errs <- updateFile(logger, dataFilePath, sigtoolPath, signature,
+				downloadMirrorURL, diffCountThreshold, verifier, parallelDownloads, progressFn)
+		}(signature)
+	}
+
+	wg.Wait()
+	close(errs)
 
+	for err := range errs {
 		if err != nil {
 			return err
 		}
@@ -103,10 +136,21 @@ func runSignatureUpdate(verboseMode bool, dataFilePath string, downloadMirrorURL
 	return nil
 }
 
+// cliOptions bundles the flags accepted by the default "sigupdate" update
+// command.
+type cliOptions struct {
+	dataFilePath       string
+	downloadMirrorURL  string
+	diffCountThreshold uint16
+	verifier           Verifier
+	parallelDownloads  uint16
+	logger             *slog.Logger
+}
+
 // Function that parses the CLI options passed to the application.
-func parseCliFlags() (bool, string, string, uint16) {
+func parseCliFlags() cliOptions {
 	verbosePart := getopt.BoolLong("verbose", 'v',
-		"Enable verbose mode with additional debugging information")
+		"Shorthand for --log-level=debug when --log-level is info (the default)")
 	versionPart := getopt.BoolLong("version", 'V',
 		"Display the version and exit")
 	dataFilePart := getopt.StringLong("data-file-path", 'd',
@@ -115,6 +159,15 @@ func parseCliFlags() (bool, string, string, uint16) {
 		100, "Number of diffs to download until we redownload the signature files")
 	downloadMirrorPart := getopt.StringLong("download-mirror-url", 'm',
 		"http://database.clamav.net", "URL to download signature updates from")
+	rootKeyPart := getopt.StringLong("root-key", 0,
+		"", "Path to the pinned Ed25519 root public key used to validate the signing-key bundle")
+	signingKeysURLPart := getopt.StringLong("signing-keys-url", 0,
+		"http://database.clamav.net/signing-keys.json", "URL to download the signing-key bundle from")
+	requireSignaturesPart := getopt.BoolLong("require-signatures", 0,
+		"Reject any downloaded CVD or CDIFF that doesn't have a valid signature")
+	parallelDownloadsPart := getopt.Uint16Long("parallel-downloads", 0,
+		4, "Number of CDIFFs to download concurrently per signature database")
+	logFormatPart, logLevelPart := addLogFlags()
 
 	getopt.Parse()
 
@@ -128,27 +181,74 @@ func parseCliFlags() (bool, string, string, uint16) {
 		os.Exit(0)
 	}
 
-	if !exists(*dataFilePart) {
-		msg := fmt.Sprintf("Data file path doesn't exist or isn't accessible: %v",
-			*dataFilePart)
-		logFatal.Fatal(msg)
+	logger := newLogger(*logFormatPart, resolveLogLevel(*verbosePart, *logLevelPart))
+	dataFileAbsPath := resolveDataFilePath(logger, *dataFilePart)
+	verifier := buildVerifier(logger, *rootKeyPart, *signingKeysURLPart, *requireSignaturesPart)
+
+	return cliOptions{
+		dataFilePath:       dataFileAbsPath,
+		downloadMirrorURL:  *downloadMirrorPart,
+		diffCountThreshold: *diffThresholdPart,
+		verifier:           verifier,
+		parallelDownloads:  *parallelDownloadsPart,
+		logger:             logger,
+	}
+}
+
+// addLogFlags registers the --log-format and --log-level flags shared by
+// every sigupdate subcommand.
+func addLogFlags() (*string, *string) {
+	logFormatPart := getopt.StringLong("log-format", 0,
+		"text", "Structured log output format: text or json")
+	logLevelPart := getopt.StringLong("log-level", 0,
+		"info", "Minimum log level to emit: debug, info, warn, or error")
+
+	return logFormatPart, logLevelPart
+}
+
+// resolveDataFilePath validates that path exists and is writable by the
+// current user, returning its absolute form. Shared by every subcommand
+// that needs to operate on the data directory.
+func resolveDataFilePath(logger *slog.Logger, path string) string {
+	if !exists(path) {
+		fatal(logger, "data file path doesn't exist or isn't accessible", "path", path)
 	}
 
-	dataFileAbsPath, err := filepath.Abs(*dataFilePart)
+	absPath, err := filepath.Abs(path)
 
 	if err != nil {
-		msg := fmt.Sprintf("Unable to parse absolute path of data file path: %v",
-			*dataFilePart)
-		logFatal.Fatal(msg)
+		fatal(logger, "unable to parse absolute path of data file path", "path", path, "error", err)
+	}
+
+	if !isWritable(absPath) {
+		fatal(logger, "data file path doesn't have write access for current user", "path", absPath)
+	}
+
+	return absPath
+}
+
+// buildVerifier constructs the Verifier implied by the --root-key,
+// --signing-keys-url and --require-signatures flags, shared by every
+// subcommand that downloads signatures. --root-key alone builds a verifier
+// that checks signatures and logs a warning on failure; --require-signatures
+// additionally makes a failed check reject the artifact.
+func buildVerifier(logger *slog.Logger, rootKeyPath string, signingKeysURL string,
+	requireSignatures bool) Verifier {
+	if rootKeyPath == "" {
+		if requireSignatures {
+			fatal(logger, "--require-signatures requires --root-key to be set")
+		}
+
+		return noopVerifier{}
 	}
 
-	if !isWritable(dataFileAbsPath) {
-		msg := fmt.Sprintf("Data file path doesn't have write access for "+
-			"current user at path: %v", dataFileAbsPath)
-		logFatal.Fatal(msg)
+	distsign, err := newDistsignVerifier(logger, rootKeyPath, signingKeysURL, requireSignatures)
+
+	if err != nil {
+		fatal(logger, "unable to build signature verifier", "error", err)
 	}
 
-	return *verbosePart, dataFileAbsPath, *downloadMirrorPart, *diffThresholdPart
+	return distsign
 }
 
 // Function that gets retrieves the value of the DNS TXT record published by
@@ -245,8 +345,9 @@ func findSigtoolPath() (string, error) {
 
 // Function that updates the data files for a given signature by either
 // downloading the datafile or downloading diffs.
-func updateFile(verboseMode bool, dataFilePath string, sigtoolPath string,
-	signature Signature, downloadMirrorURL string, diffCountThreshold uint16) error {
+func updateFile(logger *slog.Logger, dataFilePath string, sigtoolPath string,
+	signature Signature, downloadMirrorURL string, diffCountThreshold uint16,
+	verifier Verifier, parallelDownloads uint16, progressFn ProgressFunc) error {
 	filePrefix := signature.Name
 	currentVersion := signature.Version
 	separator := string(filepath.Separator)
@@ -256,9 +357,9 @@ func updateFile(verboseMode bool, dataFilePath string, sigtoolPath string,
 
 	// Download the signatures for the first time if they don't exist
 	if !exists(localFilePath) {
-		logger.Printf("Local copy of [%v] does not exist - initiating download.",
-			localFilePath)
-		_, err := downloadFile(verboseMode, filename, localFilePath, downloadMirrorURL)
+		logger.Info("sig.file.missing", "signature", filePrefix, "path", localFilePath)
+		_, err := downloadFile(logger, filename, localFilePath, downloadMirrorURL, verifier,
+			sigtoolPath, currentVersion)
 
 		if err != nil {
 			return err
@@ -267,17 +368,15 @@ func updateFile(verboseMode bool, dataFilePath string, sigtoolPath string,
 		return nil
 	}
 
-	if verboseMode {
-		logger.Printf("Local copy of [%v] already exists - "+
-			"initiating diff based update", localFilePath)
-	}
+	logger.Debug("initiating diff based update", "signature", filePrefix, "path", localFilePath)
 
 	oldVersion, err := findLocalVersion(localFilePath, sigtoolPath)
 
 	if err != nil || oldVersion < 0 {
-		logger.Printf("There was a problem with the version [%v] of file [%v]. "+
-			"The file will be downloaded again. Original Error: %v", oldVersion, localFilePath, err)
-		_, err := downloadFile(verboseMode, filename, localFilePath, downloadMirrorURL)
+		logger.Info("sig.rehash.trigger", "signature", filePrefix, "path", localFilePath,
+			"reason", "unreadable local version", "error", err)
+		_, err := downloadFile(logger, filename, localFilePath, downloadMirrorURL, verifier,
+			sigtoolPath, currentVersion)
 
 		if err != nil {
 			return err
@@ -286,41 +385,67 @@ func updateFile(verboseMode bool, dataFilePath string, sigtoolPath string,
 		return nil
 	}
 
-	if verboseMode {
-		logger.Printf("%v current version: %v", filename, oldVersion)
-	}
+	logger.Debug("resolved local signature version", "signature", filePrefix, "version", oldVersion)
 
 	/* Attempt to download a diff for each version until we reach the current
-	 * version. */
-	for count := oldVersion + 1; count <= currentVersion; count++ {
-		diffFilename := filePrefix + "-" + strconv.FormatInt(count, 10) + ".cdiff"
-		localDiffFilePath := dataFilePath + separator + diffFilename
-
-		// Don't bother downloading a diff if it already exists
-		if exists(localDiffFilePath) {
-			if verboseMode {
-				logger.Printf("Local copy of [%v] already exists, not downloading",
-					localDiffFilePath)
+	 * version. Diffs are fetched by a bounded pool of workers since, for a
+	 * database that is hundreds of diffs behind, HTTP round-trip latency
+	 * dominates - then committed into place in ascending version order so
+	 * that an interrupted run never leaves a gap in the diff chain. */
+	var versionsNeeded []int64
+
+	// oldVersion can be ahead of currentVersion - e.g. a data directory
+	// restored from a newer snapshot than a lagging --download-mirror-url -
+	// in which case there's nothing to catch up on.
+	if currentVersion > oldVersion {
+		versionsNeeded = make([]int64, 0, currentVersion-oldVersion)
+
+		for count := oldVersion + 1; count <= currentVersion; count++ {
+			diffFilename := filePrefix + "-" + strconv.FormatInt(count, 10) + ".cdiff"
+			localDiffFilePath := dataFilePath + separator + diffFilename
+
+			// Don't bother downloading a diff if it already exists
+			if exists(localDiffFilePath) {
+				logger.Debug("diff already present, skipping", "path", localDiffFilePath)
+				continue
+			}
+
+			// Or if it's already known to the content-addressed cache
+			if digest, ok := lookupRecordedDigest(dataFilePath, diffFilename); ok {
+				restored, err := restoreFromCAS(dataFilePath, digest, localDiffFilePath)
+
+				if err != nil {
+					return err
+				}
+
+				if restored {
+					logger.Info("sig.diff.restored", "signature", filePrefix, "path", localDiffFilePath,
+						"sha256", digest)
+					continue
+				}
 			}
-			continue
+
+			versionsNeeded = append(versionsNeeded, count)
 		}
+	}
 
-		_, err := downloadFile(verboseMode, diffFilename, localDiffFilePath, downloadMirrorURL)
+	if len(versionsNeeded) > 0 {
+		err := downloadDiffsWithWorkerPool(logger, dataFilePath, downloadMirrorURL, verifier,
+			parallelDownloads, progressFn, filePrefix, versionsNeeded)
 
 		/* Give up attempting to download incremental diffs if we can't find a
 		 * diff file corresponding to the version needed. We just go download
 		 * the main signature file again if we hit this case. */
 		if err != nil {
-			logger.Printf("There was a problem downloading diff [%v] of file [%v]. "+
-				"The file original file [%v] will be downloaded again. Original Error: %v",
-				count, diffFilename, filename, err)
+			logger.Info("sig.rehash.trigger", "signature", filePrefix, "from_version", oldVersion,
+				"to_version", currentVersion, "reason", "diff download failed", "error", err)
 
-			_, err := downloadFile(verboseMode, filename, localFilePath, downloadMirrorURL)
+			_, err := downloadFile(logger, filename, localFilePath, downloadMirrorURL, verifier,
+				sigtoolPath, currentVersion)
 
 			if err != nil {
 				return err
 			}
-			break
 		}
 	}
 
@@ -328,10 +453,11 @@ func updateFile(verboseMode bool, dataFilePath string, sigtoolPath string,
 	 * after we have the diffs so that our base signature files stay relatively
 	 * current. */
 	if currentVersion-oldVersion > int64(diffCountThreshold) {
-		logger.Printf("Original signature has deviated beyond threshold from diffs, "+
-			"so we are downloading the file [%v] again", filename)
+		logger.Info("sig.rehash.trigger", "signature", filePrefix, "from_version", oldVersion,
+			"to_version", currentVersion, "reason", "diff count threshold exceeded")
 
-		_, err := downloadFile(verboseMode, filename, localFilePath, downloadMirrorURL)
+		_, err := downloadFile(logger, filename, localFilePath, downloadMirrorURL, verifier,
+			sigtoolPath, currentVersion)
 
 		if err != nil {
 			return err
@@ -406,18 +532,20 @@ func findLocalVersion(localFilePath string, sigtoolPath string) (int64, error) {
 }
 
 // Function that downloads a file from the mirror URL and moves it into the
-// data directory if it was successfully downloaded.
-func downloadFile(verboseMode bool, filename string, localFilePath string,
-	downloadMirrorURL string) (int, error) {
-
+// data directory if it was successfully downloaded. sigtoolPath and
+// currentVersion are used to confirm that a CAS restore actually produced
+// the version we were asked for; unlike a CDIFF, whose filename pins an
+// immutable version, the CVD filenames this is called with are floating, so
+// a cached blob restored under that name could be stale.
+func downloadFile(logger *slog.Logger, filename string, localFilePath string,
+	downloadMirrorURL string, verifier Verifier, sigtoolPath string, currentVersion int64) (int, error) {
 	unknownStatus := -1
 	downloadURL := downloadMirrorURL + "/" + filename
-
-	output, err := ioutil.TempFile(os.TempDir(), filename+"-")
+	started := time.Now()
 
 	// Skip downloading the file if our local copy is newer than the remote copy
 	if exists(localFilePath) {
-		newer, err := checkIfRemoteIsNewer(verboseMode, localFilePath, downloadURL)
+		newer, err := checkIfRemoteIsNewer(logger, localFilePath, downloadURL)
 
 		if err != nil {
 			return unknownStatus, err
@@ -428,60 +556,157 @@ func downloadFile(verboseMode bool, filename string, localFilePath string,
 		}
 	}
 
-	if verboseMode {
-		logger.Printf("Downloading to temporary file: [%v]", output.Name())
+	dataFilePath := filepath.Dir(localFilePath)
+
+	// Consult the content-addressed cache before touching the network - the
+	// artifact may already be known even though the logical file isn't
+	// present in the data directory. Since filename is a floating name
+	// (main.cvd/daily.cvd/bytecode.cvd) rather than a version-pinned one, we
+	// still have to confirm the restored blob is actually currentVersion
+	// before trusting it - otherwise we'd silently keep serving whatever was
+	// last recorded under that name.
+	if digest, ok := lookupRecordedDigest(dataFilePath, filename); ok {
+		restored, err := restoreFromCAS(dataFilePath, digest, localFilePath)
+
+		if err != nil {
+			return unknownStatus, err
+		}
+
+		if restored {
+			restoredVersion, vErr := findLocalVersion(localFilePath, sigtoolPath)
+
+			if vErr == nil && restoredVersion == currentVersion {
+				logger.Info("sig.download.complete", "file", filename, "url", downloadURL,
+					"sha256", digest, "source", "cache")
+				return unknownStatus, nil
+			}
+
+			logger.Info("sig.cache.stale", "file", filename, "sha256", digest,
+				"cached_version", restoredVersion, "current_version", currentVersion)
+
+			if err := os.Remove(localFilePath); err != nil {
+				return unknownStatus, errwrap.Wrapf("Unable to remove stale cache restore. {{err}}", err)
+			}
+		}
+	}
+
+	statusCode, tempFilePath, lastModified, n, digest, err := fetchToTempFile(logger, filename,
+		downloadMirrorURL, verifier)
+
+	if err != nil || tempFilePath == "" {
+		return statusCode, err
+	}
+
+	if err := commitDownload(tempFilePath, localFilePath, lastModified, digest); err != nil {
+		return statusCode, err
 	}
 
+	logger.Info("sig.download.complete", "file", filename, "url", downloadURL, "bytes", n,
+		"duration_ms", time.Since(started).Milliseconds())
+
+	return statusCode, nil
+}
+
+// fetchToTempFile downloads filename from the mirror into a temporary file,
+// verifying it against verifier, but stops short of promoting it into the
+// data directory. This split lets callers that need to coordinate multiple
+// downloads - such as the CDIFF worker pool - defer the rename until all of
+// the artifacts they depend on have arrived. The SHA-256 digest is computed
+// inline via an io.MultiWriter as the response body is copied to disk, so
+// the artifact is never read from disk a second time just to hash it.
+func fetchToTempFile(logger *slog.Logger, filename string, downloadMirrorURL string,
+	verifier Verifier) (int, string, time.Time, int64, string, error) {
+	unknownStatus := -1
+	downloadURL := downloadMirrorURL + "/" + filename
+
+	output, err := ioutil.TempFile(os.TempDir(), filename+"-")
+
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create file: [%v]. {{err}}", output.Name())
-		return unknownStatus, errwrap.Wrapf(msg, err)
+		return unknownStatus, "", time.Time{}, 0, "", errwrap.Wrapf(msg, err)
 	}
 
+	logger.Debug("downloading to temporary file", "path", output.Name(), "url", downloadURL)
+
 	defer output.Close()
 
 	response, err := http.Get(downloadURL)
 
 	if err != nil {
 		msg := fmt.Sprintf("Unable to retrieve file from: [%v]. {{err}}", downloadURL)
-		return unknownStatus, errwrap.Wrapf(msg, err)
+		return unknownStatus, "", time.Time{}, 0, "", errwrap.Wrapf(msg, err)
 	}
 
 	if response.StatusCode != http.StatusOK {
 		msg := fmt.Sprintf("Unable to download file: [%v]", response.Status)
-		return response.StatusCode, errors.New(msg)
+		return response.StatusCode, "", time.Time{}, 0, "", errors.New(msg)
 	}
 
 	lastModified, err := http.ParseTime(response.Header.Get("Last-Modified"))
 
 	if err != nil {
-		logger.Printf("Error parsing last-modified header [%v] for file: %v",
-			response.Header.Get("Last-Modified"), downloadURL)
+		logger.Debug("unable to parse last-modified header, using current time",
+			"header", response.Header.Get("Last-Modified"), "url", downloadURL)
 		lastModified = time.Now()
 	}
 
 	defer response.Body.Close()
 
-	n, err := io.Copy(output, response.Body)
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(output, hasher), response.Body)
 
 	if err != nil {
-		msg := fmt.Sprintf("Error copying data from URL [%v] to local file [%v]. {{err}}",
-			downloadURL, localFilePath)
-		return response.StatusCode, errwrap.Wrapf(msg, err)
+		msg := fmt.Sprintf("Error copying data from URL [%v] to temporary file [%v]. {{err}}",
+			downloadURL, output.Name())
+		return response.StatusCode, "", time.Time{}, 0, "", errwrap.Wrapf(msg, err)
+	}
+
+	digest := hex.EncodeToString(hasher.Sum(nil))
+
+	if err := verifier.Verify(downloadMirrorURL, filename, output.Name()); err != nil {
+		os.Remove(output.Name())
+		msg := fmt.Sprintf("Signature verification failed for [%v] - discarding download. {{err}}",
+			downloadURL)
+		return response.StatusCode, "", time.Time{}, 0, "", errwrap.Wrapf(msg, err)
+	}
+
+	return response.StatusCode, output.Name(), lastModified, n, digest, nil
+}
+
+// commitDownload promotes a verified temporary file into its logical
+// location in the data directory, preserving the mirror's last-modified
+// timestamp. The artifact is stored in the content-addressed cache first -
+// keyed by digest, which fetchToTempFile already computed while downloading -
+// so that a future run - here or sharing the same cache via a symlinked data
+// directory - can restore it without hitting the network.
+func commitDownload(tempFilePath string, localFilePath string, lastModified time.Time, digest string) error {
+	dataFilePath := filepath.Dir(localFilePath)
+	filename := filepath.Base(localFilePath)
+
+	if err := storeInCAS(dataFilePath, tempFilePath, digest); err != nil {
+		return err
+	}
+
+	if err := recordDigest(dataFilePath, filename, digest); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempFilePath, localFilePath); err != nil {
+		msg := fmt.Sprintf("Unable to rename [%v] to [%v]. {{err}}", tempFilePath, localFilePath)
+		return errwrap.Wrapf(msg, err)
 	}
 
-	os.Rename(output.Name(), localFilePath)
 	/* Change the last modified time so that we have a record that corresponds to the
 	 * server's timestamps. */
 	os.Chtimes(localFilePath, lastModified, lastModified)
 
-	logger.Printf("Download complete: %v --> %v [%v bytes]", downloadURL, localFilePath, n)
-
-	return response.StatusCode, nil
+	return nil
 }
 
 // Function that checks to see if the remote file is newer than the locally stored
 // file.
-func checkIfRemoteIsNewer(verboseMode bool, localFilePath string, downloadURL string) (bool, error) {
+func checkIfRemoteIsNewer(logger *slog.Logger, localFilePath string,
+	downloadURL string) (bool, error) {
 	localFileStat, err := os.Stat(localFilePath)
 
 	if err != nil {
@@ -498,10 +723,8 @@ func checkIfRemoteIsNewer(verboseMode bool, localFilePath string, downloadURL st
 
 	remoteModTime, err := http.ParseTime(response.Header.Get("Last-Modified"))
 
-	if verboseMode {
-		logger.Printf("Local file [%v] last-modified: %v", downloadURL, localModTime)
-		logger.Printf("Remote file [%v] last-modified: %v", downloadURL, remoteModTime)
-	}
+	logger.Debug("comparing last-modified times", "url", downloadURL,
+		"local_modified", localModTime, "remote_modified", remoteModTime)
 
 	if err != nil {
 		msg := fmt.Sprintf("Error parsing last-modified header [%v] for file [%v]. {{err}}",
@@ -510,7 +733,7 @@ func checkIfRemoteIsNewer(verboseMode bool, localFilePath string, downloadURL st
 	}
 
 	if localModTime.After(remoteModTime) {
-		logger.Printf("Skipping download of [%v] because local copy is newer", downloadURL)
+		logger.Debug("skipping download, local copy is newer", "url", downloadURL)
 		return false, nil
 	}
 
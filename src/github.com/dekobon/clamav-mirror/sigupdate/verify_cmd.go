@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pborman/getopt"
+)
+
+// verifyOptions bundles the flags accepted by the "sigupdate verify"
+// subcommand.
+type verifyOptions struct {
+	dataFilePath string
+	logger       *slog.Logger
+}
+
+// parseVerifyCliFlags parses the CLI options for the "sigupdate verify"
+// subcommand.
+func parseVerifyCliFlags() verifyOptions {
+	dataFilePart := getopt.StringLong("data-file-path", 'd',
+		"/var/clamav/data", "Path to ClamAV data files")
+	logFormatPart, logLevelPart := addLogFlags()
+
+	getopt.Parse()
+
+	logger := newLogger(*logFormatPart, *logLevelPart)
+
+	if !exists(*dataFilePart) {
+		fatal(logger, "data file path doesn't exist or isn't accessible", "path", *dataFilePart)
+	}
+
+	dataFileAbsPath, err := filepath.Abs(*dataFilePart)
+
+	if err != nil {
+		fatal(logger, "unable to parse absolute path of data file path", "path", *dataFilePart, "error", err)
+	}
+
+	return verifyOptions{dataFilePath: dataFileAbsPath, logger: logger}
+}
+
+// runVerify walks opts.dataFilePath re-hashing every CVD and CDIFF,
+// cross-checks the result against the content-addressed cache, and reports
+// any file whose contents no longer match what was recorded when it was
+// downloaded. This gives operators a fast integrity-audit path that is
+// independent of sigtool.
+func runVerify(opts verifyOptions) error {
+	dataFilePath := opts.dataFilePath
+	logger := opts.logger
+
+	var corrupt []string
+	var checked int
+
+	walkErr := filepath.Walk(dataFilePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".cache" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(path, ".cvd") && !strings.HasSuffix(path, ".cdiff") {
+			return nil
+		}
+
+		checked++
+		filename := filepath.Base(path)
+
+		digest, err := sha256File(path)
+
+		if err != nil {
+			return err
+		}
+
+		recordedDigest, ok := lookupRecordedDigest(dataFilePath, filename)
+
+		if !ok {
+			logger.Debug("no recorded digest, nothing to cross-check", "path", path, "sha256", digest)
+			return nil
+		}
+
+		if digest != recordedDigest {
+			logger.Error("sig.verify.corruption", "path", path, "sha256", digest,
+				"recorded_sha256", recordedDigest)
+			corrupt = append(corrupt, path)
+			return nil
+		}
+
+		if !exists(casPath(dataFilePath, digest)) {
+			logger.Warn("digest matches but artifact missing from content-addressed cache",
+				"path", path, "sha256", digest)
+		}
+
+		return nil
+	})
+
+	if walkErr != nil {
+		return walkErr
+	}
+
+	logger.Info("sig.verify.complete", "checked", checked, "corrupt", len(corrupt))
+
+	if len(corrupt) > 0 {
+		return fmt.Errorf("integrity audit failed for %v file(s): %v", len(corrupt), strings.Join(corrupt, ", "))
+	}
+
+	return nil
+}